@@ -6,7 +6,10 @@ import (
 	"github.com/datacratic/goklog/klog"
 
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -17,6 +20,22 @@ var (
 	CarbonMaxConnDelay = 1 * time.Minute
 )
 
+// CarbonProtocol selects the wire format used by CarbonHandler to send its
+// values.
+type CarbonProtocol int
+
+const (
+	// ProtocolPlaintext sends one "key value timestamp\n" line per metric,
+	// the format understood by Carbon's plaintext listener (2003).
+	ProtocolPlaintext CarbonProtocol = iota
+
+	// ProtocolPickle batches every metric into a single Python-pickle
+	// payload framed with a 4-byte length header, the format understood by
+	// Carbon's pickle listener (2004). This avoids the per-line overhead of
+	// ProtocolPlaintext on large, high-cardinality registries.
+	ProtocolPickle
+)
+
 type msgConn struct {
 	URL  string
 	Conn net.Conn
@@ -25,11 +44,31 @@ type msgConn struct {
 type CarbonHandler struct {
 	URLs []string
 
+	// Protocol selects the wire format used to send values. Defaults to
+	// ProtocolPlaintext.
+	Protocol CarbonProtocol
+
+	// MaxBatchSize is the number of values ingested across calls to
+	// HandleMeters before a flush is triggered, counting every value passed
+	// in even if its key repeats and overwrites an already-pending value. 0
+	// disables the size-based flush; if MaxBatchDelay is also 0, batching is
+	// disabled and every call to HandleMeters is flushed as-is, which is the
+	// default.
+	MaxBatchSize int
+
+	// MaxBatchDelay is the maximum time a metric can sit in the batch
+	// before being flushed, regardless of MaxBatchSize. 0 disables the
+	// delay-based flush.
+	MaxBatchDelay time.Duration
+
 	initialize sync.Once
 
 	conns   map[string]net.Conn
 	connC   chan msgConn
 	valuesC chan map[string]float64
+
+	pending  map[string]float64
+	ingested int // values ingested into pending since the last flush
 }
 
 func (carbon *CarbonHandler) Init() {
@@ -58,17 +97,66 @@ func (carbon *CarbonHandler) init() {
 }
 
 func (carbon *CarbonHandler) run() {
+	var tickC <-chan time.Time
+
+	if carbon.MaxBatchDelay > 0 {
+		ticker := time.NewTicker(carbon.MaxBatchDelay)
+		defer ticker.Stop()
+		tickC = ticker.C
+	}
+
 	for {
 		select {
 		case values := <-carbon.valuesC:
-			carbon.send(values)
+			carbon.accumulate(values)
 
 		case msg := <-carbon.connC:
 			carbon.conns[msg.URL] = msg.Conn
+
+		case <-tickC:
+			carbon.flush()
 		}
 	}
 }
 
+// accumulate merges values into the pending batch, flushing immediately if
+// neither MaxBatchSize nor MaxBatchDelay is set (preserving the historical
+// one-flush-per-call behaviour) or if the batch has ingested MaxBatchSize
+// values. This is tracked separately from len(pending): a registry reports
+// the same stable set of keys on every call, so len(pending) plateaus at the
+// key count on the first call and would never reach MaxBatchSize again.
+func (carbon *CarbonHandler) accumulate(values map[string]float64) {
+	if carbon.MaxBatchSize == 0 && carbon.MaxBatchDelay == 0 {
+		carbon.send(values)
+		return
+	}
+
+	if carbon.pending == nil {
+		carbon.pending = make(map[string]float64, len(values))
+	}
+
+	for key, value := range values {
+		carbon.pending[key] = value
+	}
+	carbon.ingested += len(values)
+
+	if carbon.MaxBatchSize > 0 && carbon.ingested >= carbon.MaxBatchSize {
+		carbon.flush()
+	}
+}
+
+func (carbon *CarbonHandler) flush() {
+	if len(carbon.pending) == 0 {
+		return
+	}
+
+	values := carbon.pending
+	carbon.pending = nil
+	carbon.ingested = 0
+
+	carbon.send(values)
+}
+
 func (carbon *CarbonHandler) connect(URL string) {
 
 	if conn := carbon.conns[URL]; conn != nil {
@@ -123,7 +211,16 @@ func (carbon *CarbonHandler) send(values map[string]float64) {
 	}
 }
 
-func (carbon *CarbonHandler) write(conn net.Conn, values map[string]float64, ts int64) (err error) {
+func (carbon *CarbonHandler) write(conn net.Conn, values map[string]float64, ts int64) error {
+	switch carbon.Protocol {
+	case ProtocolPickle:
+		return carbon.writePickle(conn, values, ts)
+	default:
+		return carbon.writePlaintext(conn, values, ts)
+	}
+}
+
+func (carbon *CarbonHandler) writePlaintext(conn net.Conn, values map[string]float64, ts int64) (err error) {
 	writer := bufio.NewWriter(conn)
 
 	for key, value := range values {
@@ -136,4 +233,80 @@ func (carbon *CarbonHandler) write(conn net.Conn, values map[string]float64, ts
 
 	err = writer.Flush()
 	return
-}
\ No newline at end of file
+}
+
+// Pickle opcodes used to build the [(path, (timestamp, value)), ...]
+// structure that carbon-cache expects on its pickle port. Only the minimal
+// subset needed for that shape is implemented.
+const (
+	pickleProto     = "\x80\x02" // PROTO 2
+	pickleEmptyList = ']'        // EMPTY_LIST
+	pickleMark      = '('        // MARK
+	pickleShortStr  = 'U'        // SHORT_BINSTRING: 1-byte length + bytes
+	pickleLongStr   = 'T'        // BINSTRING: 4-byte little-endian length + bytes
+	pickleBinInt    = 'J'        // BININT: 4-byte little-endian signed int
+	pickleBinFloat  = 'G'        // BINFLOAT: 8-byte big-endian double
+	pickleTuple     = 't'        // TUPLE: pop back to last MARK into a tuple
+	pickleAppends   = 'e'        // APPENDS: pop back to last MARK, extend list
+	pickleStop      = '.'        // STOP
+)
+
+// writePickle serializes values as a pickle protocol 2 list of
+// (key, (timestamp, value)) tuples, prefixed with a 4-byte big-endian length
+// header, and writes the result to conn in a single call.
+func (carbon *CarbonHandler) writePickle(conn net.Conn, values map[string]float64, ts int64) error {
+	klog.KPrintf("meter.carbon.send.debug", "pickle batch of %d metrics at %d", len(values), ts)
+
+	var body bytes.Buffer
+
+	body.WriteString(pickleProto)
+	body.WriteByte(pickleEmptyList)
+	body.WriteByte(pickleMark)
+
+	for key, value := range values {
+		body.WriteByte(pickleMark)
+		writePickleString(&body, key)
+		body.WriteByte(pickleMark)
+		writePickleInt32(&body, int32(ts))
+		writePickleFloat(&body, value)
+		body.WriteByte(pickleTuple)
+		body.WriteByte(pickleTuple)
+	}
+
+	body.WriteByte(pickleAppends)
+	body.WriteByte(pickleStop)
+
+	frame := make([]byte, 4+body.Len())
+	binary.BigEndian.PutUint32(frame, uint32(body.Len()))
+	copy(frame[4:], body.Bytes())
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+func writePickleString(buf *bytes.Buffer, s string) {
+	if len(s) < 256 {
+		buf.WriteByte(pickleShortStr)
+		buf.WriteByte(byte(len(s)))
+	} else {
+		buf.WriteByte(pickleLongStr)
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(s)))
+		buf.Write(length[:])
+	}
+	buf.WriteString(s)
+}
+
+func writePickleInt32(buf *bytes.Buffer, value int32) {
+	buf.WriteByte(pickleBinInt)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(value))
+	buf.Write(b[:])
+}
+
+func writePickleFloat(buf *bytes.Buffer, value float64) {
+	buf.WriteByte(pickleBinFloat)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(value))
+	buf.Write(b[:])
+}
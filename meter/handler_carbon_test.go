@@ -0,0 +1,123 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestWritePickleString covers both the SHORT_BINSTRING and BINSTRING
+// encodings, which diverge at a 256-byte key length.
+func TestWritePickleString(t *testing.T) {
+	var buf bytes.Buffer
+	writePickleString(&buf, "requests.count")
+
+	want := append([]byte{pickleShortStr, byte(len("requests.count"))}, []byte("requests.count")...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("got %v, want %v", buf.Bytes(), want)
+	}
+
+	long := bytes.Repeat([]byte("a"), 300)
+	buf.Reset()
+	writePickleString(&buf, string(long))
+
+	if buf.Bytes()[0] != pickleLongStr {
+		t.Fatalf("expected long string opcode, got %q", buf.Bytes()[0])
+	}
+	length := binary.LittleEndian.Uint32(buf.Bytes()[1:5])
+	if length != uint32(len(long)) {
+		t.Fatalf("got length %d, want %d", length, len(long))
+	}
+}
+
+func TestWritePickleInt32(t *testing.T) {
+	var buf bytes.Buffer
+	writePickleInt32(&buf, 1700000000)
+
+	if buf.Bytes()[0] != pickleBinInt {
+		t.Fatalf("expected BININT opcode, got %q", buf.Bytes()[0])
+	}
+	if got := binary.LittleEndian.Uint32(buf.Bytes()[1:5]); got != 1700000000 {
+		t.Fatalf("got %d", got)
+	}
+}
+
+func TestWritePickleFloat(t *testing.T) {
+	var buf bytes.Buffer
+	writePickleFloat(&buf, 12.5)
+
+	if buf.Bytes()[0] != pickleBinFloat {
+		t.Fatalf("expected BINFLOAT opcode, got %q", buf.Bytes()[0])
+	}
+	if got := binary.BigEndian.Uint64(buf.Bytes()[1:9]); got != 0x4029000000000000 {
+		t.Fatalf("got %#x", got)
+	}
+}
+
+// TestCarbonWritePickle checks the overall framing: a 4-byte big-endian
+// length header matching the body's length, a body starting with PROTO 2 and
+// ending with STOP, and the key present somewhere in between.
+func TestCarbonWritePickle(t *testing.T) {
+	carbon := &CarbonHandler{Protocol: ProtocolPickle}
+
+	var conn bytes.Buffer
+	if err := carbon.writePickle(fakeConn{&conn}, map[string]float64{"requests.count": 42}, 1700000000); err != nil {
+		t.Fatalf("writePickle: %s", err)
+	}
+
+	length := binary.BigEndian.Uint32(conn.Bytes()[:4])
+	body := conn.Bytes()[4:]
+	if int(length) != len(body) {
+		t.Fatalf("header length %d doesn't match body length %d", length, len(body))
+	}
+
+	if !bytes.HasPrefix(body, []byte(pickleProto)) {
+		t.Fatalf("body doesn't start with PROTO 2: %v", body[:2])
+	}
+	if body[len(body)-1] != pickleStop {
+		t.Fatalf("body doesn't end with STOP")
+	}
+	if !bytes.Contains(body, []byte("requests.count")) {
+		t.Fatalf("body doesn't contain the key: %v", body)
+	}
+}
+
+// TestCarbonAccumulateFlushesOnStableKeySet guards against counting
+// len(pending) (distinct keys) instead of values ingested: a registry that
+// reports the same stable set of keys on every call must still eventually
+// flush once MaxBatchSize values have been ingested, even though the
+// pending map itself never grows past the key count.
+func TestCarbonAccumulateFlushesOnStableKeySet(t *testing.T) {
+	var conn bytes.Buffer
+	carbon := &CarbonHandler{
+		MaxBatchSize: 6,
+		conns:        map[string]net.Conn{"host:2003": fakeConn{&conn}},
+	}
+
+	stable := map[string]float64{"a": 1, "b": 2}
+	for i := 0; i < 3; i++ {
+		carbon.accumulate(stable)
+	}
+
+	if conn.Len() == 0 {
+		t.Fatal("expected a stable key set to eventually flush, got no bytes written")
+	}
+	if carbon.pending != nil || carbon.ingested != 0 {
+		t.Fatalf("expected batch to be reset after flush, got pending=%v ingested=%d", carbon.pending, carbon.ingested)
+	}
+}
+
+// fakeConn is a net.Conn that writes to an in-memory buffer, just enough to
+// exercise writePickle's framing without opening a real socket.
+type fakeConn struct{ *bytes.Buffer }
+
+func (fakeConn) Close() error                       { return nil }
+func (fakeConn) LocalAddr() net.Addr                { return nil }
+func (fakeConn) RemoteAddr() net.Addr               { return nil }
+func (fakeConn) SetDeadline(t time.Time) error      { return nil }
+func (fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (fakeConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,157 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// statSuffixes lists the stat names appended by the Meter implementations in
+// this package (see Distribution.ReadMeter and EWMA.Peek) so that a flat
+// "key.stat" value can be grouped back under its originating meter.
+var statSuffixes = map[string]bool{
+	"count": true,
+	"p00":   true,
+	"p50":   true,
+	"p90":   true,
+	"p99":   true,
+	"pmx":   true,
+	"mean":  true,
+	"m1":    true,
+	"m5":    true,
+	"m15":   true,
+}
+
+// MeterSource provides a non-destructive snapshot of every currently
+// registered meter, keyed and flattened the same way Handler.HandleMeters
+// receives them. A registry that exposes its own Peek satisfies this
+// interface.
+type MeterSource interface {
+	Peek() map[string]float64
+}
+
+// HTTPHandler exposes every meter in a MeterSource as JSON or, via
+// "?format=prometheus", in Prometheus text exposition format. It is meant to
+// be mounted directly on an existing mux, e.g.
+//
+//	http.Handle("/metrics", &meter.HTTPHandler{Source: registry})
+//
+// Because scraping uses Peek rather than ReadMeter, mounting an HTTPHandler
+// doesn't steal samples from whatever else is consuming the same meters
+// (e.g. a CarbonHandler flush).
+type HTTPHandler struct {
+	Source MeterSource
+}
+
+func (handler *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	values := handler.Source.Peek()
+
+	if r.URL.Query().Get("format") == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, values)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groupValues(values))
+}
+
+// groupValues re-assembles the flat "key.stat" values produced by this
+// package's Meters into a map of meter name to its stats, e.g.
+// {"requests.latency": {"count": 1, "p50": 12.3}}. A key with no recognized
+// stat suffix is reported as {"value": ...}.
+func groupValues(values map[string]float64) map[string]map[string]float64 {
+	grouped := make(map[string]map[string]float64)
+
+	for key, value := range values {
+		name, stat := splitStat(key)
+
+		if grouped[name] == nil {
+			grouped[name] = make(map[string]float64)
+		}
+		grouped[name][stat] = value
+	}
+
+	return grouped
+}
+
+func splitStat(key string) (name, stat string) {
+	i := strings.LastIndex(key, ".")
+	if i < 0 {
+		return key, "value"
+	}
+
+	suffix := key[i+1:]
+	if !statSuffixes[suffix] {
+		return key, "value"
+	}
+
+	return key[:i], suffix
+}
+
+var prometheusQuantiles = map[string]string{
+	"p00": "0",
+	"p50": "0.5",
+	"p90": "0.9",
+	"p99": "0.99",
+	"pmx": "1",
+}
+
+var prometheusNameReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// writePrometheus renders the same values reported by groupValues in
+// Prometheus text exposition format: Distribution stats become a summary
+// (quantile lines plus a _count), EWMA stats become a gauge per window, and
+// anything left with a single bare "value" becomes a plain gauge line.
+//
+// Distribution doesn't track a running sum of recorded values, so unlike a
+// typical Prometheus summary this never emits a "_sum" line.
+func writePrometheus(w io.Writer, values map[string]float64) {
+	grouped := groupValues(values)
+
+	names := make([]string, 0, len(grouped))
+	for name := range grouped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := grouped[name]
+		metric := prometheusNameReplacer.Replace(name)
+
+		if value, ok := stats["value"]; ok && len(stats) == 1 {
+			fmt.Fprintf(w, "%s %s\n", metric, formatFloat(value))
+			continue
+		}
+
+		if count, ok := stats["count"]; ok {
+			for _, suffix := range []string{"p00", "p50", "p90", "p99", "pmx"} {
+				if value, ok := stats[suffix]; ok {
+					fmt.Fprintf(w, "%s{quantile=\"%s\"} %s\n", metric, prometheusQuantiles[suffix], formatFloat(value))
+				}
+			}
+			fmt.Fprintf(w, "%s_count %s\n", metric, formatFloat(count))
+
+			for _, suffix := range []string{"mean", "m1", "m5", "m15"} {
+				if value, ok := stats[suffix]; ok {
+					fmt.Fprintf(w, "%s_%s %s\n", metric, suffix, formatFloat(value))
+				}
+			}
+			continue
+		}
+
+		for stat, value := range stats {
+			fmt.Fprintf(w, "%s_%s %s\n", metric, stat, formatFloat(value))
+		}
+	}
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
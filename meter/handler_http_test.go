@@ -0,0 +1,73 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeMeterSource map[string]float64
+
+func (src fakeMeterSource) Peek() map[string]float64 { return src }
+
+func TestHTTPHandlerJSON(t *testing.T) {
+	handler := &HTTPHandler{Source: fakeMeterSource{
+		"requests.latency.count": 2,
+		"requests.latency.p50":   1.5,
+		"errors":                 1,
+	}}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	var grouped map[string]map[string]float64
+	if err := json.Unmarshal(rec.Body.Bytes(), &grouped); err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+
+	if grouped["requests.latency"]["count"] != 2 || grouped["requests.latency"]["p50"] != 1.5 {
+		t.Fatalf("got %v", grouped["requests.latency"])
+	}
+	if grouped["errors"]["value"] != 1 {
+		t.Fatalf("got %v", grouped["errors"])
+	}
+}
+
+func TestHTTPHandlerPrometheus(t *testing.T) {
+	handler := &HTTPHandler{Source: fakeMeterSource{
+		"requests.latency.count": 2,
+		"requests.latency.p50":   1.5,
+		"errors":                 1,
+	}}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics?format=prometheus", nil)
+	handler.ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"requests_latency{quantile=\"0.5\"} 1.5\n",
+		"requests_latency_count 2\n",
+		"errors 1\n",
+	} {
+		if !bytes.Contains([]byte(body), []byte(want)) {
+			t.Fatalf("expected body to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestSplitStat(t *testing.T) {
+	if name, stat := splitStat("requests.latency.p99"); name != "requests.latency" || stat != "p99" {
+		t.Fatalf("got (%q, %q)", name, stat)
+	}
+	if name, stat := splitStat("errors"); name != "errors" || stat != "value" {
+		t.Fatalf("got (%q, %q)", name, stat)
+	}
+	if name, stat := splitStat("a.b.unknown"); name != "a.b.unknown" || stat != "value" {
+		t.Fatalf("got (%q, %q)", name, stat)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"github.com/datacratic/goklog/klog"
+
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	InfluxMaxConnDelay = 1 * time.Minute
+
+	// InfluxDefaultBatchSize is used if BatchSize is left unset on
+	// InfluxHandler.
+	InfluxDefaultBatchSize = 500
+
+	// InfluxDefaultBatchInterval is used if BatchInterval is left unset on
+	// InfluxHandler.
+	InfluxDefaultBatchInterval = 10 * time.Second
+
+	// InfluxDefaultQueueSize is used if QueueSize is left unset on
+	// InfluxHandler.
+	InfluxDefaultQueueSize = 10000
+)
+
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	field       string
+	value       float64
+	ts          int64
+}
+
+// InfluxHandler follows the same Init/HandleMeters(values map[string]float64)
+// contract as CarbonHandler, batching values into InfluxDB line-protocol
+// points and POSTing them to the HTTP `/write` endpoint. It supports both
+// InfluxDB v1 (database + basic auth) and v2 (org/bucket + token auth).
+//
+// Points are buffered in a bounded queue and flushed either every
+// BatchInterval or as soon as BatchSize points have accumulated, whichever
+// comes first. If the queue is full, the oldest point is dropped to make
+// room and counted in Dropped.
+//
+// Flushed batches are handed to a single background sender that retries a
+// failing write until it succeeds before picking up the next batch, so a
+// backend outage never piles up more than one batch's worth of retrying
+// goroutines and HTTP requests. While the sender is retrying, at most one
+// further batch waits in a one-batch hand-off buffer; a batch that's ready to
+// flush while that buffer is full is dropped (and counted in Dropped).
+type InfluxHandler struct {
+
+	// URL is the base URL of the InfluxDB server, e.g. "http://host:8086".
+	URL string
+
+	// Version selects the /write API to target: 1 for InfluxDB v1
+	// (database + basic auth) or 2 for InfluxDB v2 (org/bucket + token).
+	// Defaults to 1.
+	Version int
+
+	// DB is the InfluxDB v1 database to write to.
+	DB string
+
+	// Username and Password are used for basic auth against InfluxDB v1.
+	Username string
+	Password string
+
+	// Org, Bucket and Token are used against InfluxDB v2.
+	Org    string
+	Bucket string
+	Token  string
+
+	// KeyToPoint maps a metric key and value to an Influx measurement, tag
+	// set and field name. Defaults to splitting the Carbon-style
+	// dot-separated key on its first dot: the first segment becomes the
+	// measurement and the remainder becomes the field (or "value" if the
+	// key has no dot).
+	KeyToPoint func(key string, value float64) (measurement string, tags map[string]string, field string)
+
+	// BatchSize is the number of points accumulated before a flush is
+	// triggered. Defaults to InfluxDefaultBatchSize.
+	BatchSize int
+
+	// BatchInterval is the maximum time a point can sit in the queue before
+	// being flushed. Defaults to InfluxDefaultBatchInterval.
+	BatchInterval time.Duration
+
+	// QueueSize caps the number of points held in memory while waiting to
+	// be flushed. Defaults to InfluxDefaultQueueSize.
+	QueueSize int
+
+	// Client is used to issue the HTTP POST requests. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	dropped int64
+
+	mutex      sync.Mutex
+	queue      []influxPoint
+	initialize sync.Once
+	valuesC    chan map[string]float64
+	sendC      chan []influxPoint
+}
+
+// Init initializes the handler and starts its background flusher. Can be
+// called repeatedly and is only required if HandleMeters isn't used to send
+// the first batch of values.
+func (influx *InfluxHandler) Init() {
+	influx.initialize.Do(influx.init)
+}
+
+// HandleMeters queues values for the next flush, matching the signature
+// CarbonHandler and the rest of this package's handlers use.
+func (influx *InfluxHandler) HandleMeters(values map[string]float64) {
+	influx.Init()
+	influx.valuesC <- values
+}
+
+// Dropped returns the number of points dropped so far, either because the
+// queue was full or because their batch was dropped while the sender was
+// busy retrying. Intended to be polled and fed back into a Gauge or Counter so it's
+// visible alongside the rest of a registry's metrics.
+func (influx *InfluxHandler) Dropped() int64 {
+	return atomic.LoadInt64(&influx.dropped)
+}
+
+func (influx *InfluxHandler) init() {
+	if len(influx.URL) == 0 {
+		klog.KFatal("meter.influx.init.error", "no URL configured")
+	}
+
+	if influx.Version == 0 {
+		influx.Version = 1
+	}
+	if influx.BatchSize == 0 {
+		influx.BatchSize = InfluxDefaultBatchSize
+	}
+	if influx.BatchInterval == 0 {
+		influx.BatchInterval = InfluxDefaultBatchInterval
+	}
+	if influx.QueueSize == 0 {
+		influx.QueueSize = InfluxDefaultQueueSize
+	}
+	if influx.Client == nil {
+		influx.Client = http.DefaultClient
+	}
+	if influx.KeyToPoint == nil {
+		influx.KeyToPoint = defaultKeyToPoint
+	}
+
+	influx.valuesC = make(chan map[string]float64)
+	influx.sendC = make(chan []influxPoint, 1)
+
+	go influx.run()
+	go influx.runSend()
+}
+
+func defaultKeyToPoint(key string, value float64) (measurement string, tags map[string]string, field string) {
+	if i := strings.IndexByte(key, '.'); i >= 0 {
+		return key[:i], nil, key[i+1:]
+	}
+	return key, nil, "value"
+}
+
+func (influx *InfluxHandler) run() {
+	ticker := time.NewTicker(influx.BatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case values := <-influx.valuesC:
+			influx.enqueue(values)
+
+		case <-ticker.C:
+			influx.flush()
+		}
+	}
+}
+
+func (influx *InfluxHandler) enqueue(values map[string]float64) {
+	ts := time.Now().UnixNano()
+
+	influx.mutex.Lock()
+
+	for key, value := range values {
+		measurement, tags, field := influx.KeyToPoint(key, value)
+
+		for len(influx.queue) >= influx.QueueSize {
+			influx.queue = influx.queue[1:]
+			atomic.AddInt64(&influx.dropped, 1)
+		}
+
+		influx.queue = append(influx.queue, influxPoint{
+			measurement: measurement,
+			tags:        tags,
+			field:       field,
+			value:       value,
+			ts:          ts,
+		})
+	}
+
+	ready := len(influx.queue) >= influx.BatchSize
+	influx.mutex.Unlock()
+
+	if ready {
+		influx.flush()
+	}
+}
+
+func (influx *InfluxHandler) flush() {
+	influx.mutex.Lock()
+	if len(influx.queue) == 0 {
+		influx.mutex.Unlock()
+		return
+	}
+	batch := influx.queue
+	influx.queue = nil
+	influx.mutex.Unlock()
+
+	select {
+	case influx.sendC <- batch:
+	default:
+		klog.KPrintf("meter.influx.send.dropped", "dropping batch of %d points: still retrying a previous batch against '%s'", len(batch), influx.URL)
+		atomic.AddInt64(&influx.dropped, int64(len(batch)))
+	}
+}
+
+// runSend retries and sends batches one at a time off of sendC. Like
+// CarbonHandler's dial/reconnect, it runs in its own goroutine so that a
+// backend outage retries in the background instead of blocking run, which
+// would otherwise wedge every future enqueue/HandleMeters call behind it
+// since valuesC is unbuffered. Unlike spawning a goroutine per flush, a
+// single sender bounds a prolonged outage to one batch retrying at a time
+// instead of piling up a new retrying goroutine every BatchInterval.
+func (influx *InfluxHandler) runSend() {
+	for batch := range influx.sendC {
+		influx.send(batch)
+	}
+}
+
+// send retries writing batch until it succeeds.
+func (influx *InfluxHandler) send(batch []influxPoint) {
+	for attempts := 0; ; attempts++ {
+		influx.sleep(attempts)
+
+		if err := influx.write(batch); err != nil {
+			klog.KPrintf("meter.influx.send.error", "error when sending to '%s': %s", influx.URL, err)
+			continue
+		}
+
+		return
+	}
+}
+
+func (influx *InfluxHandler) sleep(attempts int) {
+	if attempts == 0 {
+		return
+	}
+
+	sleepFor := time.Duration(attempts*2) * time.Second
+
+	if sleepFor < InfluxMaxConnDelay {
+		time.Sleep(sleepFor)
+	} else {
+		time.Sleep(InfluxMaxConnDelay)
+	}
+}
+
+func (influx *InfluxHandler) write(batch []influxPoint) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+
+	for _, point := range batch {
+		fmt.Fprint(gz, lineProtocol(point))
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", influx.writeURL(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+
+	switch influx.Version {
+	case 2:
+		req.Header.Set("Authorization", "Token "+influx.Token)
+	default:
+		if len(influx.Username) > 0 {
+			req.SetBasicAuth(influx.Username, influx.Password)
+		}
+	}
+
+	resp, err := influx.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status '%s'", resp.Status)
+	}
+	return nil
+}
+
+func (influx *InfluxHandler) writeURL() string {
+	values := make(url.Values)
+
+	switch influx.Version {
+	case 2:
+		values.Set("org", influx.Org)
+		values.Set("bucket", influx.Bucket)
+	default:
+		values.Set("db", influx.DB)
+	}
+
+	return strings.TrimRight(influx.URL, "/") + "/write?" + values.Encode()
+}
+
+func lineProtocol(point influxPoint) string {
+	var line bytes.Buffer
+
+	line.WriteString(escapeInflux(point.measurement))
+
+	for tag, value := range point.tags {
+		line.WriteByte(',')
+		line.WriteString(escapeInflux(tag))
+		line.WriteByte('=')
+		line.WriteString(escapeInflux(value))
+	}
+
+	line.WriteByte(' ')
+	line.WriteString(escapeInflux(point.field))
+	line.WriteByte('=')
+	line.WriteString(strconv.FormatFloat(point.value, 'f', -1, 64))
+
+	fmt.Fprintf(&line, " %d\n", point.ts)
+
+	return line.String()
+}
+
+var influxEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+
+func escapeInflux(value string) string {
+	return influxEscaper.Replace(value)
+}
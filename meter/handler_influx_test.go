@@ -0,0 +1,97 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxLineProtocol(t *testing.T) {
+	line := lineProtocol(influxPoint{
+		measurement: "requests",
+		tags:        map[string]string{"host": "a b"},
+		field:       "latency",
+		value:       12.5,
+		ts:          1700000000,
+	})
+
+	want := "requests,host=a\\ b latency=12.5 1700000000\n"
+	if line != want {
+		t.Fatalf("got %q, want %q", line, want)
+	}
+}
+
+func TestInfluxDefaultKeyToPoint(t *testing.T) {
+	measurement, tags, field := defaultKeyToPoint("requests.latency.p50", 1)
+	if measurement != "requests" || field != "latency.p50" || tags != nil {
+		t.Fatalf("got (%q, %v, %q)", measurement, tags, field)
+	}
+
+	measurement, _, field = defaultKeyToPoint("requests", 1)
+	if measurement != "requests" || field != "value" {
+		t.Fatalf("got (%q, %q)", measurement, field)
+	}
+}
+
+// TestInfluxHandleMetersDoesNotBlockOnFailingBackend guards against flush
+// retrying synchronously inside run: if it did, a second HandleMeters call
+// would never return while the first batch is being retried against a
+// backend that keeps failing.
+func TestInfluxHandleMetersDoesNotBlockOnFailingBackend(t *testing.T) {
+	InfluxMaxConnDelay = 10 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	influx := &InfluxHandler{
+		URL:           server.URL,
+		BatchSize:     1,
+		BatchInterval: time.Hour,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		influx.HandleMeters(map[string]float64{"a": 1})
+		influx.HandleMeters(map[string]float64{"b": 2})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleMeters blocked on a failing backend")
+	}
+}
+
+// TestInfluxDropsBatchWhileSenderIsBusy guards against spawning a new
+// retrying goroutine per flush: during a sustained outage, once the single
+// sender is retrying a batch and its one-batch hand-off buffer is full, any
+// further ready batch must be dropped rather than kept around to retry
+// concurrently.
+func TestInfluxDropsBatchWhileSenderIsBusy(t *testing.T) {
+	InfluxMaxConnDelay = time.Hour
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	influx := &InfluxHandler{
+		URL:           server.URL,
+		BatchSize:     1,
+		BatchInterval: time.Hour,
+	}
+
+	for i := 0; i < 5; i++ {
+		influx.HandleMeters(map[string]float64{"a": float64(i)})
+	}
+
+	if dropped := influx.Dropped(); dropped == 0 {
+		t.Fatal("expected batches to be dropped while the sender retries the first one")
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"github.com/datacratic/goklog/klog"
+
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	StatsdDialTimeout  = 1 * time.Second
+	StatsdMaxConnDelay = 1 * time.Minute
+)
+
+// StatsdMaxPacketSize is the UDP payload size used to pack the StatsD line
+// protocol when StatsdHandler.MTU is left unset. It leaves headroom for the IP and
+// UDP headers within a standard 1500 byte Ethernet frame.
+const StatsdMaxPacketSize = 1432
+
+// StatsdFlushInterval is the default interval at which buffered metrics are
+// flushed when StatsdHandler.FlushInterval is left unset.
+const StatsdFlushInterval = 1 * time.Second
+
+// StatsdKind selects the StatsD metric type used to report a value.
+type StatsdKind string
+
+// Metric types supported by the StatsD line protocol.
+const (
+	StatsdCounter StatsdKind = "c"
+	StatsdGauge   StatsdKind = "g"
+	StatsdHisto   StatsdKind = "h"
+)
+
+// statsdSuffixKinds maps the suffixes used by Distribution.ReadMeter to the
+// StatsD kind they're best reported as. This is a best-effort, suffix-based
+// guess, not a guarantee: "count" is reported as a counter, and the
+// percentile suffixes (p00/p50/p90/p99/pmx) as gauges, since each is already
+// a single aggregated value computed by Distribution.ReadMeter rather than a raw
+// sample — sending them with kind StatsdHisto would have the StatsD agent
+// compute percentiles of percentiles, which isn't meaningful. Anything that
+// doesn't match a known suffix is also reported as a gauge. Callers that
+// ship raw per-event samples (and want the agent itself to compute
+// percentiles) should set Kind to return StatsdHisto for those keys.
+var statsdSuffixKinds = map[string]StatsdKind{
+	"count": StatsdCounter,
+	"p00":   StatsdGauge,
+	"p50":   StatsdGauge,
+	"p90":   StatsdGauge,
+	"p99":   StatsdGauge,
+	"pmx":   StatsdGauge,
+}
+
+// StatsdHandler follows the same Init/HandleMeters(values map[string]float64)
+// contract as CarbonHandler, shipping values over UDP using the
+// StatsD/DogStatsD line protocol (`name:value|kind|@rate|#tag:val,...`). It
+// can be pointed at any agent that speaks the protocol, such as Datadog's
+// dogstatsd, Telegraf or Vector.
+//
+// DogStatsD-style tags can be attached to a metric in one of two ways: a
+// '#tag=value,tag2=value2' suffix on the key (stripped before the metric is
+// sent), or globally via Tags. Tags parsed from the key take precedence over
+// Tags on conflicts.
+//
+// StatsdHandler mirrors CarbonHandler's dial and reconnect logic and is
+// completely go-routine safe.
+type StatsdHandler struct {
+
+	// URL is the host:port of the StatsD/DogStatsD agent to send metrics to.
+	URL string
+
+	// Tags are appended to every metric sent through this handler.
+	Tags map[string]string
+
+	// Kind, if set, overrides the inferred StatsD kind for a given key. When
+	// unset, the kind is inferred from the key's Distribution suffix (see
+	// statsdSuffixKinds) and defaults to StatsdGauge otherwise.
+	Kind func(key string) StatsdKind
+
+	// SampleRate, when strictly between 0 and 1, is attached to every metric
+	// as '|@rate'. Any other value is not sent.
+	SampleRate float64
+
+	// MTU caps the size in bytes of a single UDP packet. Defaults to
+	// StatsdMaxPacketSize.
+	MTU int
+
+	// FlushInterval is how often the handler flushes its buffered packet
+	// even if the MTU hasn't been reached. Defaults to StatsdFlushInterval.
+	FlushInterval time.Duration
+
+	initialize sync.Once
+
+	conn    net.Conn
+	connC   chan net.Conn
+	valuesC chan map[string]float64
+}
+
+// Init initializes the handler. Can be called repeatedly and is only
+// required if HandleMeters isn't used to send the first batch of values.
+func (statsd *StatsdHandler) Init() {
+	statsd.initialize.Do(statsd.init)
+}
+
+// HandleMeters queues values for the next flush, matching the signature
+// CarbonHandler and the rest of this package's handlers use.
+func (statsd *StatsdHandler) HandleMeters(values map[string]float64) {
+	statsd.Init()
+	statsd.valuesC <- values
+}
+
+func (statsd *StatsdHandler) init() {
+	if len(statsd.URL) == 0 {
+		klog.KFatal("meter.statsd.init.error", "no URL configured")
+	}
+
+	if statsd.MTU == 0 {
+		statsd.MTU = StatsdMaxPacketSize
+	}
+	if statsd.FlushInterval == 0 {
+		statsd.FlushInterval = StatsdFlushInterval
+	}
+
+	statsd.connC = make(chan net.Conn)
+	statsd.valuesC = make(chan map[string]float64)
+
+	statsd.connect()
+
+	go statsd.run()
+}
+
+func (statsd *StatsdHandler) run() {
+	ticker := time.NewTicker(statsd.FlushInterval)
+	defer ticker.Stop()
+
+	buffer := new(bytes.Buffer)
+
+	for {
+		select {
+		case values := <-statsd.valuesC:
+			statsd.pack(buffer, values)
+
+		case conn := <-statsd.connC:
+			statsd.conn = conn
+
+		case <-ticker.C:
+			statsd.flush(buffer)
+		}
+	}
+}
+
+func (statsd *StatsdHandler) connect() {
+	if statsd.conn != nil {
+		statsd.conn.Close()
+		statsd.conn = nil
+	}
+
+	go statsd.dial()
+}
+
+func (statsd *StatsdHandler) dial() {
+	for attempts := 0; ; attempts++ {
+		statsd.sleep(attempts)
+
+		conn, err := net.DialTimeout("udp", statsd.URL, StatsdDialTimeout)
+		if err == nil {
+			klog.KPrintf("meter.statsd.dial.info", "connected to '%s'", statsd.URL)
+			statsd.connC <- conn
+			return
+		}
+
+		klog.KPrintf("meter.statsd.dial.error", "unable to connect to '%s': %s", statsd.URL, err)
+	}
+}
+
+func (statsd *StatsdHandler) sleep(attempts int) {
+	if attempts == 0 {
+		return
+	}
+
+	sleepFor := time.Duration(attempts*2) * time.Second
+
+	if sleepFor < StatsdMaxConnDelay {
+		time.Sleep(sleepFor)
+	} else {
+		time.Sleep(StatsdMaxConnDelay)
+	}
+}
+
+// pack appends the given values to buffer as StatsD lines, flushing
+// whenever the next line would push the buffer past the configured MTU.
+func (statsd *StatsdHandler) pack(buffer *bytes.Buffer, values map[string]float64) {
+	for key, value := range values {
+		line := statsd.line(key, value)
+
+		if buffer.Len() > 0 && buffer.Len()+len(line) > statsd.MTU {
+			statsd.flush(buffer)
+		}
+
+		buffer.WriteString(line)
+	}
+
+	if buffer.Len() >= statsd.MTU {
+		statsd.flush(buffer)
+	}
+}
+
+func (statsd *StatsdHandler) line(key string, value float64) string {
+	name, tags := splitTags(key)
+
+	kind := statsd.kindOf(name)
+
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%s:%s|%s", name, strconv.FormatFloat(value, 'f', -1, 64), kind)
+
+	if statsd.SampleRate > 0 && statsd.SampleRate < 1 {
+		fmt.Fprintf(&line, "|@%s", strconv.FormatFloat(statsd.SampleRate, 'f', -1, 64))
+	}
+
+	if merged := statsd.mergeTags(tags); len(merged) > 0 {
+		line.WriteString("|#")
+		line.WriteString(strings.Join(merged, ","))
+	}
+
+	line.WriteByte('\n')
+	return line.String()
+}
+
+// kindOf infers the StatsD kind to report name as. This is best-effort and
+// suffix-based (see statsdSuffixKinds): it has no way to tell a real counter
+// from an arbitrary gauge-like key, so anything without a recognized suffix
+// defaults to StatsdGauge. Callers that need exact kinds should set Kind.
+func (statsd *StatsdHandler) kindOf(name string) StatsdKind {
+	if statsd.Kind != nil {
+		return statsd.Kind(name)
+	}
+
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		if kind, ok := statsdSuffixKinds[name[i+1:]]; ok {
+			return kind
+		}
+	}
+
+	return StatsdGauge
+}
+
+func (statsd *StatsdHandler) mergeTags(keyTags map[string]string) (result []string) {
+	seen := make(map[string]bool, len(statsd.Tags)+len(keyTags))
+
+	add := func(tag, value string) {
+		if seen[tag] {
+			return
+		}
+		seen[tag] = true
+		result = append(result, tag+":"+value)
+	}
+
+	for tag, value := range keyTags {
+		add(tag, value)
+	}
+	for tag, value := range statsd.Tags {
+		add(tag, value)
+	}
+
+	return
+}
+
+// splitTags extracts the '#tag=value,tag2=value2' suffix from a metric key,
+// as used to carry DogStatsD tags on a key without a parallel tag map.
+func splitTags(key string) (name string, tags map[string]string) {
+	i := strings.IndexByte(key, '#')
+	if i < 0 {
+		return key, nil
+	}
+
+	name = key[:i]
+	tags = make(map[string]string)
+
+	for _, pair := range strings.Split(key[i+1:], ",") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		}
+	}
+
+	return
+}
+
+func (statsd *StatsdHandler) flush(buffer *bytes.Buffer) {
+	if buffer.Len() == 0 {
+		return
+	}
+
+	if statsd.conn != nil {
+		if _, err := statsd.conn.Write(buffer.Bytes()); err != nil {
+			klog.KPrintf("meter.statsd.send.error", "error when sending to '%s': %s", statsd.URL, err)
+			statsd.connect()
+		}
+	}
+
+	buffer.Reset()
+}
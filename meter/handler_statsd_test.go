@@ -0,0 +1,58 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import "testing"
+
+func TestStatsdKindOf(t *testing.T) {
+	statsd := &StatsdHandler{}
+
+	cases := map[string]StatsdKind{
+		"requests.count":  StatsdCounter,
+		"latency.p50":     StatsdGauge,
+		"latency.p99":     StatsdGauge,
+		"latency.pmx":     StatsdGauge,
+		"active_sessions": StatsdGauge,
+	}
+
+	for key, want := range cases {
+		if got := statsd.kindOf(key); got != want {
+			t.Errorf("kindOf(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestStatsdKindOfOverride(t *testing.T) {
+	statsd := &StatsdHandler{
+		Kind: func(name string) StatsdKind { return StatsdHisto },
+	}
+
+	if got := statsd.kindOf("requests.count"); got != StatsdHisto {
+		t.Fatalf("got %q, want %q", got, StatsdHisto)
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	name, tags := splitTags("requests.count#host=a,region=us")
+	if name != "requests.count" {
+		t.Fatalf("got name %q", name)
+	}
+	if tags["host"] != "a" || tags["region"] != "us" {
+		t.Fatalf("got tags %v", tags)
+	}
+
+	name, tags = splitTags("requests.count")
+	if name != "requests.count" || tags != nil {
+		t.Fatalf("got (%q, %v)", name, tags)
+	}
+}
+
+func TestStatsdLine(t *testing.T) {
+	statsd := &StatsdHandler{Tags: map[string]string{"env": "prod"}}
+
+	line := statsd.line("requests.count#host=a", 3)
+	want := "requests.count:3|c|#host:a,env:prod\n"
+	if line != want {
+		t.Fatalf("got %q, want %q", line, want)
+	}
+}
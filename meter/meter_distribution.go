@@ -5,6 +5,7 @@ package meter
 import (
 	"math"
 	"math/rand"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -22,6 +23,11 @@ const DefaultDistributionSize = 1000
 // elements recorded. This schemes ensures that a distribution has a constant
 // memory footprint and doesn't need to allocate for calls to Record.
 //
+// Internally, Record is spread over a fixed number of shards so that
+// concurrent callers rarely contend on the same mutex. ReadMeter merges the
+// shards back into a single reservoir before computing its statistics so the
+// public API and output are unaffected by sharding.
+//
 // ReadMeter will compute percentiles over the sampled distribution and the min
 // and max value seen over the entire distribution.
 //
@@ -74,6 +80,18 @@ func (dist *Distribution) ReadMeter(_ time.Duration) map[string]float64 {
 	return (*distribution)(oldState).Read()
 }
 
+// Peek computes the same statistics as ReadMeter but without discarding the
+// recorded elements, so that scraping a Distribution doesn't steal samples
+// from whatever else is reading it (e.g. a Carbon flush).
+func (dist *Distribution) Peek() map[string]float64 {
+	state := (*distribution)(atomic.LoadPointer(&dist.state))
+	if state == nil {
+		return make(map[string]float64)
+	}
+
+	return state.Read()
+}
+
 func (dist *Distribution) getSize() int {
 	if dist.Size == 0 {
 		return DefaultDistributionSize
@@ -85,45 +103,114 @@ func (dist *Distribution) getSeed() int64 {
 	return atomic.AddInt64(&dist.SamplingSeed, 1)
 }
 
+// distribution is the sharded reservoir used internally by Distribution. Each
+// shard owns its own buffer, count, min/max and RNG so that Record on shard i
+// never contends with Record on shard j.
 type distribution struct {
+	shards   []*shard
+	mask     uint32
+	capacity int // logical reservoir size after merging, i.e. Distribution.Size
+}
+
+type shard struct {
 	items    []float64
-	count    int
+	count    int64
 	min, max float64
 
 	rand  *rand.Rand
 	mutex sync.Mutex
 }
 
+// shardCount returns the number of shards to use for a distribution: the
+// next power of two greater than or equal to GOMAXPROCS, so that a shard
+// index can be derived with a mask instead of a modulo.
+func shardCount() int {
+	n := runtime.GOMAXPROCS(0)
+
+	count := 1
+	for count < n {
+		count <<= 1
+	}
+	return count
+}
+
+// newDistribution gives every shard its own full-size buffer rather than
+// splitting size across shards. That costs more memory (up to shardCount()
+// times size instead of size) but means the merge in Read has real headroom
+// to weigh shards against each other instead of being forced to keep every
+// item it's handed, which is what let a low-traffic shard and a high-traffic
+// shard contribute equally to the merged reservoir regardless of their
+// actual share of the stream.
 func newDistribution(size int, seed int64) *distribution {
-	return &distribution{
+	n := shardCount()
+
+	shards := make([]*shard, n)
+	for i := 0; i < n; i++ {
+		shards[i] = newShard(size, seed+int64(i))
+	}
+
+	return &distribution{shards: shards, mask: uint32(n - 1), capacity: size}
+}
+
+func newShard(size int, seed int64) *shard {
+	return &shard{
 		items: make([]float64, size),
 		min:   math.MaxFloat64,
+		max:   -math.MaxFloat64,
 
 		rand: rand.New(rand.NewSource(seed)),
 	}
 }
 
+// shardCursor is a global hint for which shard to try first. It doesn't need
+// to be (and won't be) stable per goroutine: its only job is to spread
+// concurrent callers across different starting points so they don't all
+// probe shards in the same order.
+var shardCursor uint32
+
+// Record picks a shard to record value on. Rather than relying on a fixed or
+// pooled affinity, which can't guarantee that two concurrent callers land on
+// different shards, it starts at a cheap rotating index and try-locks
+// shards in order until one is free, falling back to a blocking Lock on the
+// starting shard if every shard is contended.
 func (dist *distribution) Record(value float64) {
-	dist.mutex.Lock()
-
-	dist.count++
+	start := atomic.AddUint32(&shardCursor, 1) & dist.mask
+	n := uint32(len(dist.shards))
 
-	if dist.count <= len(dist.items) {
-		dist.items[dist.count-1] = value
+	for i := uint32(0); i < n; i++ {
+		s := dist.shards[(start+i)&dist.mask]
 
-	} else if i := dist.rand.Int63n(int64(dist.count)); int(i) < len(dist.items) {
-		dist.items[i] = value
+		if s.mutex.TryLock() {
+			s.recordLocked(value)
+			s.mutex.Unlock()
+			return
+		}
 	}
 
-	if value < dist.min {
-		dist.min = value
+	s := dist.shards[start]
+	s.mutex.Lock()
+	s.recordLocked(value)
+	s.mutex.Unlock()
+}
+
+// recordLocked applies value to the shard. Callers must hold s.mutex.
+func (s *shard) recordLocked(value float64) {
+	s.count++
+
+	if s.count <= int64(len(s.items)) {
+		s.items[s.count-1] = value
+
+	} else if i := s.rand.Int63n(s.count); int(i) < len(s.items) {
+		s.items[i] = value
 	}
 
-	if value > dist.max {
-		dist.max = value
+	if value < s.min {
+		s.min = value
 	}
 
-	dist.mutex.Unlock()
+	if value > s.max {
+		s.max = value
+	}
 }
 
 type float64Array []float64
@@ -132,22 +219,27 @@ func (array float64Array) Len() int           { return len(array) }
 func (array float64Array) Swap(i, j int)      { array[i], array[j] = array[j], array[i] }
 func (array float64Array) Less(i, j int) bool { return array[i] < array[j] }
 
+// Read merges every shard into a single reservoir and computes statistics
+// over the result.
+//
+// Each shard's stored items are a uniform sample of that shard's own stream,
+// so an item from a shard that discarded most of what it saw stands in for
+// far more of the original stream than an item from a shard that kept
+// everything. merge accounts for this with a weighted sample without
+// replacement (Efraimidis-Spirakis): every stored item is assigned a key
+// drawn so that items representing more of the stream are more likely to
+// rank highest, and the top Size keys become the merged reservoir. Unlike a
+// plain concatenation of each shard's sample, this keeps the merged result
+// proportional to how much of the real stream each shard actually saw.
 func (dist *distribution) Read() map[string]float64 {
-	if dist.count == 0 {
-		return map[string]float64{}
-	}
-
-	items := make([]float64, len(dist.items))
-	for i := 0; i < len(dist.items); i++ {
-		items[i] = dist.items[i]
-	}
+	items, count, min, max := dist.merge()
 
-	n := dist.count
-	if dist.count > len(items) {
-		n = len(items)
+	if count == 0 {
+		return map[string]float64{}
 	}
 
-	sort.Sort(float64Array(items[:n]))
+	n := len(items)
+	sort.Sort(float64Array(items))
 
 	percentile := func(p int) float64 {
 		index := float32(n) / 100 * float32(p)
@@ -155,11 +247,90 @@ func (dist *distribution) Read() map[string]float64 {
 	}
 
 	return map[string]float64{
-		"count": float64(dist.count),
-		"p00":   dist.min,
+		"count": float64(count),
+		"p00":   min,
 		"p50":   percentile(50),
 		"p90":   percentile(90),
 		"p99":   percentile(99),
-		"pmx":   dist.max,
+		"pmx":   max,
+	}
+}
+
+// snapshot returns a consistent copy of a shard's count, min, max and
+// recorded items without disturbing concurrent calls to Record. Used by
+// merge so that Peek can read a live distribution rather than only one
+// that's already been swapped out by ReadMeter.
+func (s *shard) snapshot() (items []float64, count int64, min, max float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count, min, max = s.count, s.min, s.max
+
+	n := count
+	if n > int64(len(s.items)) {
+		n = int64(len(s.items))
+	}
+
+	items = make([]float64, n)
+	copy(items, s.items[:n])
+	return
+}
+
+// weightedItem is a candidate for the merged reservoir: value is the
+// recorded sample and key is its Efraimidis-Spirakis sampling key, used to
+// rank candidates regardless of which shard or in what order they arrived.
+type weightedItem struct {
+	value float64
+	key   float64
+}
+
+func (dist *distribution) merge() (items []float64, count int64, min, max float64) {
+	min = math.MaxFloat64
+	max = -math.MaxFloat64
+
+	var pool []weightedItem
+
+	for _, s := range dist.shards {
+		sItems, sCount, sMin, sMax := s.snapshot()
+
+		count += sCount
+		if sCount == 0 {
+			continue
+		}
+
+		if sMin < min {
+			min = sMin
+		}
+		if sMax > max {
+			max = sMax
+		}
+
+		// Each stored item stands in for weight = sCount/len(sItems) original
+		// observations, since that's how many of the shard's real
+		// observations its own reservoir sampling compressed down to it.
+		weight := float64(sCount) / float64(len(sItems))
+
+		for _, value := range sItems {
+			key := math.Pow(rand.Float64(), 1/weight)
+			pool = append(pool, weightedItem{value: value, key: key})
+		}
 	}
+
+	if len(pool) == 0 {
+		return nil, count, min, max
+	}
+
+	sort.Slice(pool, func(i, j int) bool { return pool[i].key > pool[j].key })
+
+	n := dist.capacity
+	if n > len(pool) {
+		n = len(pool)
+	}
+
+	items = make([]float64, n)
+	for i := 0; i < n; i++ {
+		items[i] = pool[i].value
+	}
+
+	return
 }
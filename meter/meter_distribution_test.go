@@ -0,0 +1,65 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestDistributionMergeWeighsByShardCount reproduces the skew that a naive
+// concatenation of per-shard samples produces: a shard that has seen almost
+// none of the stream must not get equal footing in the merged reservoir
+// with a shard that has seen almost all of it.
+func TestDistributionMergeWeighsByShardCount(t *testing.T) {
+	rare := newShard(200, 1)
+	for i := 0; i < 101; i++ {
+		rare.recordLocked(9999)
+	}
+
+	common := newShard(200, 2)
+	for i := 0; i < 1000000; i++ {
+		common.recordLocked(1)
+	}
+
+	dist := &distribution{shards: []*shard{rare, common}, mask: 1, capacity: 200}
+	stats := dist.Read()
+
+	if stats["count"] != 1000101 {
+		t.Fatalf("expected count 1000101, got %v", stats["count"])
+	}
+
+	for _, stat := range []string{"p50", "p90", "p99"} {
+		if stats[stat] != 1 {
+			t.Errorf("expected %s to reflect the dominant value 1, got %v", stat, stats[stat])
+		}
+	}
+}
+
+// TestDistributionRecordConcurrentNoLoss exercises the try-lock shard
+// rotation under real concurrency: regardless of which shard each Record
+// lands on, every recorded value must be accounted for.
+func TestDistributionRecordConcurrentNoLoss(t *testing.T) {
+	dist := &Distribution{Size: 100}
+
+	const goroutines = 16
+	const perGoroutine = 1000
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				dist.Record(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := dist.ReadMeter(0)
+	if got, want := stats["count"], float64(goroutines*perGoroutine); got != want {
+		t.Fatalf("expected count %v, got %v", want, got)
+	}
+}
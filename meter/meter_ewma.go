@@ -0,0 +1,147 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EWMATickInterval is the interval at which EWMA drains its uncounted
+// accumulator into the 1, 5 and 15 minute moving averages. The decay
+// constants below are derived assuming this interval, so it shouldn't be
+// changed after an EWMA has started ticking.
+var EWMATickInterval = 5 * time.Second
+
+// Decay constants for the 1, 5 and 15 minute moving averages, assuming a
+// tick every EWMATickInterval. These match the constants used by
+// rcrowley/go-metrics and the venerable Unix load average.
+var (
+	ewmaM1Alpha  = 1 - math.Exp(-5.0/60.0)
+	ewmaM5Alpha  = 1 - math.Exp(-5.0/300.0)
+	ewmaM15Alpha = 1 - math.Exp(-5.0/900.0)
+)
+
+// EWMA tracks the rate of events using exponentially-weighted moving
+// averages over 1, 5 and 15 minute windows, the same way rcrowley/go-metrics
+// does.
+//
+// Mark is allocation-free and lock-free. ReadMeter returns a snapshot of the
+// three windows in events/second along with the total count and the mean
+// rate since the EWMA was created. Unlike Distribution, reading an EWMA does
+// not reset it.
+//
+// EWMA is completely go-routine safe.
+type EWMA struct {
+	uncounted int64 // atomic: events recorded since the last tick
+	total     int64 // atomic: events recorded since creation
+
+	start time.Time
+
+	mutex   sync.Mutex
+	ticking bool
+	m1      float64
+	m5      float64
+	m15     float64
+
+	stopC      chan struct{}
+	initialize sync.Once
+	closeOnce  sync.Once
+}
+
+// Init initializes the EWMA and starts its background ticker. Can be called
+// repeatedly and is only required if Mark isn't used to record the first
+// event.
+func (ewma *EWMA) Init() {
+	ewma.initialize.Do(ewma.init)
+}
+
+func (ewma *EWMA) init() {
+	ewma.start = time.Now()
+	ewma.stopC = make(chan struct{})
+
+	go ewma.run()
+}
+
+// Mark adds n to the number of events observed since the last tick.
+func (ewma *EWMA) Mark(n int64) {
+	ewma.Init()
+
+	atomic.AddInt64(&ewma.uncounted, n)
+	atomic.AddInt64(&ewma.total, n)
+}
+
+// Close stops the background ticker. It is idempotent and safe to call
+// multiple times.
+func (ewma *EWMA) Close() {
+	ewma.Init()
+
+	ewma.closeOnce.Do(func() { close(ewma.stopC) })
+}
+
+func (ewma *EWMA) run() {
+	ticker := time.NewTicker(EWMATickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ewma.tick()
+
+		case <-ewma.stopC:
+			return
+		}
+	}
+}
+
+func (ewma *EWMA) tick() {
+	uncounted := atomic.SwapInt64(&ewma.uncounted, 0)
+	instant := float64(uncounted) / EWMATickInterval.Seconds()
+
+	ewma.mutex.Lock()
+	defer ewma.mutex.Unlock()
+
+	if !ewma.ticking {
+		ewma.m1, ewma.m5, ewma.m15 = instant, instant, instant
+		ewma.ticking = true
+		return
+	}
+
+	ewma.m1 += ewmaM1Alpha * (instant - ewma.m1)
+	ewma.m5 += ewmaM5Alpha * (instant - ewma.m5)
+	ewma.m15 += ewmaM15Alpha * (instant - ewma.m15)
+}
+
+// ReadMeter returns the current count, mean rate and 1/5/15-minute moving
+// averages, all in events/second.
+func (ewma *EWMA) ReadMeter(_ time.Duration) map[string]float64 {
+	return ewma.Peek()
+}
+
+// Peek returns the same snapshot as ReadMeter. It exists because reading an
+// EWMA is already non-destructive, so a scraper can use Peek without caring
+// whether the underlying Meter resets on read.
+func (ewma *EWMA) Peek() map[string]float64 {
+	ewma.Init()
+
+	ewma.mutex.Lock()
+	m1, m5, m15 := ewma.m1, ewma.m5, ewma.m15
+	ewma.mutex.Unlock()
+
+	total := atomic.LoadInt64(&ewma.total)
+
+	var mean float64
+	if elapsed := time.Since(ewma.start).Seconds(); elapsed > 0 {
+		mean = float64(total) / elapsed
+	}
+
+	return map[string]float64{
+		"count": float64(total),
+		"mean":  mean,
+		"m1":    m1,
+		"m5":    m5,
+		"m15":   m15,
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2014 Datacratic. All rights reserved.
+
+package meter
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEWMATickBlendsTowardInstantRate(t *testing.T) {
+	ewma := &EWMA{}
+	ewma.Init()
+	defer ewma.Close()
+
+	mark := int64(EWMATickInterval.Seconds()) * 10 // 10 events/sec this tick
+	ewma.uncounted = mark
+	ewma.tick()
+
+	stats := ewma.Peek()
+	if stats["m1"] != 10 || stats["m5"] != 10 || stats["m15"] != 10 {
+		t.Fatalf("expected first tick to set all windows to the instant rate, got %v", stats)
+	}
+
+	ewma.uncounted = 0
+	ewma.tick()
+
+	want := 10 + ewmaM1Alpha*(0-10)
+	if got := stats["m1"]; math.Abs(got-10) > 1e-9 {
+		t.Fatalf("unexpected m1 %v before second tick", got)
+	}
+	if got := ewma.Peek()["m1"]; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("m1 after second tick = %v, want %v", got, want)
+	}
+}
+
+func TestEWMAPeekDoesNotReset(t *testing.T) {
+	ewma := &EWMA{}
+	ewma.Mark(5)
+
+	first := ewma.Peek()
+	second := ewma.Peek()
+
+	if first["count"] != 5 || second["count"] != 5 {
+		t.Fatalf("expected count to stay at 5 across reads, got %v then %v", first["count"], second["count"])
+	}
+}